@@ -11,26 +11,105 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
-	"path"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"syscall"
 
 	bufra "github.com/avvmoto/buf-readerat"
 	"github.com/blakesmith/ar"
 	"github.com/gabriel-vasile/mimetype"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
 	"github.com/pkg/errors"
 	"github.com/saracen/go7z"
 	"github.com/sassoftware/go-rpmutils"
 	"github.com/xi2/xz"
 	"howett.net/plist"
 
+	"github.com/cashapp/hermit/archive/contenthash"
+	"github.com/cashapp/hermit/archive/filter"
 	"github.com/cashapp/hermit/manifest"
 	"github.com/cashapp/hermit/ui"
 	"github.com/cashapp/hermit/util"
 )
 
+// digestSuffix is appended to pkg.Dest to form the path of the persisted
+// tree digest, so subsequent runs can detect on-disk tampering without
+// needing a database.
+const digestSuffix = ".hermit-digest"
+
+// ExtractWorkers controls how many goroutines extractZip and
+// extractPackageTarball use to perform per-entry I/O concurrently. It
+// defaults to GOMAXPROCS; tests or callers extracting onto slow or
+// single-spindle storage may want to lower it.
+var ExtractWorkers = runtime.GOMAXPROCS(0)
+
+func workerCount() int {
+	if ExtractWorkers < 1 {
+		return 1
+	}
+	return ExtractWorkers
+}
+
+// newPool starts "n" workers running jobs sent on the returned channel.
+// Call stop() once all jobs have been submitted; it closes the channel,
+// waits for the workers to drain, and returns the first error encountered
+// (if any) -- the other workers keep draining the queue rather than
+// stopping early, so stop() always returns once every job has run.
+func newPool(n int) (jobs chan<- func() error, stop func() error) {
+	ch := make(chan func() error)
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			for job := range ch {
+				if err := job(); err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+				}
+			}
+		}()
+	}
+	return ch, func() error {
+		close(ch)
+		wg.Wait()
+		close(errs)
+		return <-errs
+	}
+}
+
+// Checksum returns the recursive content digest of an already-extracted
+// package, as computed by Extract when it was installed.
+func Checksum(dest string) (contenthash.Digest, error) {
+	return contenthash.Checksum(dest)
+}
+
+// VerifyChecksum recomputes the content digest of an already-extracted
+// package and compares it against the digest persisted at install time,
+// returning an error if they differ (eg. because the installed files were
+// modified on disk).
+func VerifyChecksum(dest string) error {
+	expected, err := ioutil.ReadFile(dest + digestSuffix)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return contenthash.Verify(dest, contenthash.Digest(expected))
+}
+
 // Extract from "source" to package destination.
+//
+// If pkg.Digest is set, the recursive content digest of the extracted tree
+// is verified against it before the tree is renamed into place; a mismatch
+// fails the extraction and leaves pkg.Dest untouched. The pinned digest is
+// that of the tree as extracted, before its write permission bits are
+// cleared, so it differs from the digest that Checksum returns for the
+// installed package.
 func Extract(b *ui.Task, source string, pkg *manifest.Package) (err error) {
 	task := b.SubTask("unpack")
 	if _, err := os.Stat(pkg.Dest); err == nil {
@@ -59,40 +138,20 @@ func Extract(b *ui.Task, source string, pkg *manifest.Package) (err error) {
 		return errors.WithStack(err)
 	}
 
-	// Cleanup or finalise temporary directory.
+	// Cleanup or finalise temporary directory. finalizeExtract is called
+	// unconditionally (as long as the extraction itself succeeded) so that
+	// any failure it returns -- a rename, a digest mismatch, a chmod -- is
+	// always both reported *and* cleaned up; a deferred closure that sets
+	// "err" itself rather than delegating to a plain function return is too
+	// easy to get wrong, since a stray ":=" anywhere inside it would shadow
+	// the named return for every statement after it.
 	defer func() {
+		if err == nil {
+			err = finalizeExtract(task, tmpDest, pkg, renameResult)
+		}
 		if err != nil {
 			task.Tracef("rm -rf %q", tmpDest)
 			_ = os.RemoveAll(tmpDest)
-			return
-		}
-		tmpRoot := filepath.Join(tmpDest, strings.TrimPrefix(pkg.Root, pkg.Dest))
-		for old, new := range pkg.Rename {
-			task.Tracef("  mv %q %q", old, new)
-			err = errors.WithStack(os.Rename(filepath.Join(tmpRoot, old), filepath.Join(tmpRoot, new)))
-			if err != nil {
-				break
-			}
-		}
-		// Make the unpacked destination files read-only.
-		err = filepath.Walk(tmpDest, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			task.Tracef("chmod a-w %q", path)
-			return errors.WithStack(os.Chmod(path, info.Mode()&^0222))
-		})
-		if err != nil {
-			return
-		}
-		// Make the base directory writeable so we can rename it.
-		task.Tracef("chmod 700 %q", tmpDest)
-		if err = errors.WithStack(os.Chmod(tmpDest, 0700)); err != nil { // nolint: gosec
-			return
-		}
-		task.Tracef("mv %q %q", tmpDest, pkg.Dest)
-		if renameResult {
-			err = errors.WithStack(os.Rename(tmpDest, pkg.Dest))
 		}
 	}()
 
@@ -111,20 +170,23 @@ func Extract(b *ui.Task, source string, pkg *manifest.Package) (err error) {
 	defer task.Done()
 	r = io.TeeReader(r, task.ProgressWriter())
 
+	fltr := filterFor(pkg)
+
 	// Archive is a single executable.
 	switch mime.String() {
 	case "application/zip":
-		return extractZip(task, f, info, tmpDest, pkg.Strip)
+		return extractZip(task, f, info, tmpDest, pkg.Strip, fltr)
 
 	case "application/x-7z-compressed":
-		return extract7Zip(f, info.Size(), tmpDest, pkg.Strip)
+		return extract7Zip(f, info.Size(), tmpDest, pkg.Strip, fltr)
 
 	case "application/x-mach-binary", "application/x-elf",
-		"application/x-executable", "application/x-sharedlib":
-		return extractExecutable(r, tmpDest, path.Base(pkg.Source))
+		"application/x-executable", "application/x-sharedlib",
+		"application/vnd.microsoft.portable-executable":
+		return extractExecutableOrSelfExtracting(task, f, r, info, tmpDest, pkg, mime.String())
 
 	case "application/x-tar":
-		return extractPackageTarball(task, r, tmpDest, pkg.Strip)
+		return extractPackageTarball(task, r, tmpDest, pkg.Strip, fltr)
 
 	case "application/vnd.debian.binary-package":
 		renameResult = false
@@ -139,6 +201,97 @@ func Extract(b *ui.Task, source string, pkg *manifest.Package) (err error) {
 
 }
 
+// finalizeExtract applies pkg.Rename, then -- unless this is an
+// intermediate unpack that will be re-extracted by a recursive Extract call
+// -- verifies pkg.Digest (if pinned) against a fresh recursive content
+// digest of tmpDest, locks the tree down read-only, renames it into
+// pkg.Dest and persists the digest alongside it.
+//
+// renameResult is false for the outer .deb ar-member unpack performed by
+// extractDebianPackage: that tmpDest holds only the extracted data.tar
+// member, not the package's final contents, so there is nothing here to
+// digest, lock down or rename -- the recursive Extract call it makes does
+// all of that against the real payload.
+func finalizeExtract(task *ui.Task, tmpDest string, pkg *manifest.Package, renameResult bool) error {
+	tmpRoot := filepath.Join(tmpDest, strings.TrimPrefix(pkg.Root, pkg.Dest))
+	for old, new := range pkg.Rename {
+		task.Tracef("  mv %q %q", old, new)
+		if err := errors.WithStack(os.Rename(filepath.Join(tmpRoot, old), filepath.Join(tmpRoot, new))); err != nil {
+			return err
+		}
+	}
+
+	if !renameResult {
+		return nil
+	}
+
+	// Compute a recursive content digest of the tree as extracted, before we
+	// lock it down, to check against any digest pinned in the manifest.
+	digest, err := contenthash.Checksum(tmpDest)
+	if err != nil {
+		return err
+	}
+	task.Debugf("tree digest for %s is %s", pkg.Dest, digest)
+
+	if pkg.Digest != "" && digest != contenthash.Digest(pkg.Digest) {
+		return errors.Errorf("%s: tree digest %s does not match expected digest %s pinned in manifest", pkg.Dest, digest, pkg.Digest)
+	}
+
+	// Make the unpacked destination files read-only.
+	err = filepath.Walk(tmpDest, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		task.Tracef("chmod a-w %q", path)
+		return errors.WithStack(os.Chmod(path, info.Mode()&^0222))
+	})
+	if err != nil {
+		return err
+	}
+	// Make the base directory writeable so we can rename it.
+	task.Tracef("chmod 700 %q", tmpDest)
+	if err := errors.WithStack(os.Chmod(tmpDest, 0700)); err != nil { // nolint: gosec
+		return err
+	}
+	// Locking the tree down changed its modes, so recompute the digest that
+	// is persisted beside pkg.Dest; Checksum and VerifyChecksum on the
+	// installed package reproduce this value, so future runs can detect
+	// tampering.
+	if digest, err = contenthash.Checksum(tmpDest); err != nil {
+		return err
+	}
+	task.Tracef("mv %q %q", tmpDest, pkg.Dest)
+	if err := errors.WithStack(os.Rename(tmpDest, pkg.Dest)); err != nil {
+		return err
+	}
+	return errors.WithStack(ioutil.WriteFile(pkg.Dest+digestSuffix, []byte(digest), 0600))
+}
+
+// filterFor builds the include/exclude/chmod filter described by a
+// manifest's extract{} block. pkg.Extract is the zero value (extract
+// everything unchanged) unless the manifest configures one.
+func filterFor(pkg *manifest.Package) *filter.Filter {
+	return filter.New(pkg.Extract.Include, pkg.Extract.Exclude, convertChmodRules(pkg.Extract.ChmodRules))
+}
+
+func convertChmodRules(rules []manifest.ChmodRule) []filter.ChmodRule {
+	out := make([]filter.ChmodRule, len(rules))
+	for i, r := range rules {
+		out[i] = filter.ChmodRule{Pattern: r.Pattern, Mode: r.Mode}
+	}
+	return out
+}
+
+// relEntryPath returns the archive-relative, forward-slash path of destFile
+// within dest, for matching against filter patterns.
+func relEntryPath(dest, destFile string) string {
+	rel, err := filepath.Rel(dest, destFile)
+	if err != nil {
+		return destFile
+	}
+	return filepath.ToSlash(rel)
+}
+
 type hdiEntry struct {
 	DevEntry   string `plist:"dev-entry"`
 	MountPoint string `plist:"mount-point"`
@@ -220,6 +373,45 @@ func extractExecutable(r io.Reader, dest, executableName string) error {
 	return errors.WithStack(err)
 }
 
+// decompressors maps a compressed stream's detected MIME type to the
+// streaming reader that decompresses it. Supporting a new compression
+// format in openArchive only requires adding one entry here.
+var decompressors = map[string]func(io.Reader) (io.Reader, error){
+	"application/gzip": func(r io.Reader) (io.Reader, error) {
+		zr, err := gzip.NewReader(r)
+		return zr, errors.WithStack(err)
+	},
+	"application/x-bzip2": func(r io.Reader) (io.Reader, error) {
+		return bzip2.NewReader(r), nil
+	},
+	"application/x-xz": func(r io.Reader) (io.Reader, error) {
+		xr, err := xz.NewReader(r, 0)
+		return xr, errors.WithStack(err)
+	},
+	"application/zstd": func(r io.Reader) (io.Reader, error) {
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return zr.IOReadCloser(), nil
+	},
+	"application/x-lz4": func(r io.Reader) (io.Reader, error) {
+		return lz4.NewReader(r), nil
+	},
+}
+
+// lz4FrameMagic is the magic number of an LZ4 frame, as found at the start
+// of eg. Arch/Alpine packages and some Rust toolchain tarballs. mimetype
+// (as of the version we depend on) doesn't recognise it, so we sniff it
+// ourselves as a fallback.
+var lz4FrameMagic = []byte{0x04, 0x22, 0x4d, 0x18}
+
+func isLZ4Frame(f *os.File) bool {
+	buf := make([]byte, len(lz4FrameMagic))
+	n, err := f.ReadAt(buf, 0)
+	return err == nil && n == len(buf) && bytes.Equal(buf, lz4FrameMagic)
+}
+
 // Open a potentially compressed archive.
 //
 // It will return the MIME type of the underlying file, and a buffered io.Reader for that file.
@@ -238,28 +430,19 @@ func openArchive(source string) (f *os.File, r io.Reader, mime *mimetype.MIME, e
 		}
 	}()
 	r = f
-	switch mime.String() {
-	case "application/gzip":
-		zr, err := gzip.NewReader(r)
-		if err != nil {
-			return nil, nil, mime, errors.WithStack(err)
-		}
-		r = zr
-
-	case "application/x-bzip2":
-		r = bzip2.NewReader(r)
-
-	case "application/x-xz":
-		xr, err := xz.NewReader(r, 0)
-		if err != nil {
-			return nil, nil, mime, errors.WithStack(err)
-		}
-		r = xr
-
-	default:
+	mimeStr := mime.String()
+	if _, ok := decompressors[mimeStr]; !ok && isLZ4Frame(f) {
+		mimeStr = "application/x-lz4"
+	}
+	decompress, ok := decompressors[mimeStr]
+	if !ok {
 		// Assume it's uncompressed?
 		return f, r, mime, nil
 	}
+	r, err = decompress(r)
+	if err != nil {
+		return nil, nil, mime, err
+	}
 
 	// Now detect the underlying file type.
 	buf := make([]byte, 4096)
@@ -314,29 +497,49 @@ func extractMacPKG(b *ui.Task, path, dest string, strip int) error {
 		"-applyChoiceChangesXML", changesf.Name())
 }
 
-func extractZip(b *ui.Task, f *os.File, info os.FileInfo, dest string, strip int) error {
+func extractZip(b *ui.Task, f *os.File, info os.FileInfo, dest string, strip int, fltr *filter.Filter) error {
 	zr, err := zip.NewReader(bufra.NewBufReaderAt(f, int(info.Size())), info.Size())
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	return extractZipReader(b, zr, dest, strip, fltr)
+}
+
+// extractZipReader unpacks an already-opened zip.Reader, shared by extractZip
+// and the self-extracting-executable path in selfextract.go.
+func extractZipReader(b *ui.Task, zr *zip.Reader, dest string, strip int, fltr *filter.Filter) error {
 	task := b.SubProgress("unpack", len(zr.File))
 	defer task.Done()
+	// zip's central directory lets each entry be opened independently, so
+	// entries can be extracted concurrently by a bounded worker pool.
+	jobs, stop := newPool(workerCount())
 	for _, zf := range zr.File {
 		b.Tracef("  %s", zf.Name)
 		task.Add(1)
-		destFile := makeDestPath(dest, zf.Name, strip)
+		destFile, err := makeDestPath(dest, zf.Name, strip)
+		if err != nil {
+			_ = stop()
+			return err
+		}
 		if destFile == "" {
 			continue
 		}
-		err = extractZipFile(zf, destFile)
-		if err != nil {
-			return errors.Wrap(err, destFile)
+		mode, skip := fltr.Apply(relEntryPath(dest, destFile), zf.Mode()&^0077)
+		if skip {
+			continue
+		}
+		zf, destFile, mode := zf, destFile, mode
+		jobs <- func() error {
+			if err := extractZipFile(zf, destFile, mode); err != nil {
+				return errors.Wrap(err, destFile)
+			}
+			return nil
 		}
 	}
-	return nil
+	return stop()
 }
 
-func extractZipFile(zf *zip.File, destFile string) error {
+func extractZipFile(zf *zip.File, destFile string, mode os.FileMode) error {
 	zfr, err := zf.Open()
 	if err != nil {
 		return errors.WithStack(err)
@@ -345,10 +548,15 @@ func extractZipFile(zf *zip.File, destFile string) error {
 	if zf.Mode().IsDir() {
 		return errors.WithStack(os.MkdirAll(destFile, 0700))
 	}
-	w, err := os.OpenFile(destFile, os.O_CREATE|os.O_WRONLY, zf.Mode()&^0077)
-	if err != nil {
+	// Concurrent extraction means a file's directory entry isn't guaranteed
+	// to have been processed first, so ensure the parent exists here too.
+	if err := os.MkdirAll(filepath.Dir(destFile), 0700); err != nil {
 		return errors.WithStack(err)
 	}
+	w, err := createRegularFile(destFile, mode)
+	if err != nil {
+		return err
+	}
 	_, err = io.Copy(w, zfr) // nolint: gosec
 	if err != nil {
 		return errors.WithStack(err)
@@ -361,68 +569,191 @@ func extractZipFile(zf *zip.File, destFile string) error {
 	return nil
 }
 
-func extractPackageTarball(b *ui.Task, r io.Reader, dest string, strip int) error {
+// tarInlineThreshold is the largest entry size that extractPackageTarball
+// will buffer in memory while staging it for a worker; bigger entries are
+// spilled to a temporary file instead, so a handful of huge entries can't
+// blow out memory while the (single-threaded) tar reader races ahead of the
+// workers writing previous entries to disk.
+const tarInlineThreshold = 4 << 20 // 4MiB
+
+// stagedTarEntry holds a tar entry's content read off the (single-threaded,
+// sequential) tar.Reader, so that a worker can write it to disk later
+// without holding up the reader from moving on to the next header.
+type stagedTarEntry struct {
+	data    []byte
+	tmpFile string
+}
+
+func stageTarEntry(tr *tar.Reader, size int64) (*stagedTarEntry, error) {
+	if size <= tarInlineThreshold {
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(tr, buf); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return &stagedTarEntry{data: buf}, nil
+	}
+	tmp, err := ioutil.TempFile("", "hermit-tar-spill-*")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer tmp.Close() // nolint: errcheck, gosec
+	if _, err := io.Copy(tmp, tr); err != nil {
+		_ = os.Remove(tmp.Name())
+		return nil, errors.WithStack(err)
+	}
+	return &stagedTarEntry{tmpFile: tmp.Name()}, nil
+}
+
+func (s *stagedTarEntry) writeTo(destFile string, mode os.FileMode) error {
+	var r io.Reader = bytes.NewReader(s.data)
+	if s.tmpFile != "" {
+		f, err := os.Open(s.tmpFile) // nolint: gosec
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer f.Close()            // nolint: errcheck
+		defer os.Remove(s.tmpFile) // nolint: errcheck
+		r = f
+	}
+	w, err := createRegularFile(destFile, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r) // nolint: gosec
+	_ = w.Close()
+	return errors.WithStack(err)
+}
+
+// tarLinkTracker lets a hard-link-to-symlink conversion wait until the
+// worker writing its target file has actually finished, since workers now
+// race each other instead of running strictly in archive order.
+type tarLinkTracker struct {
+	mu      sync.Mutex
+	entries map[string]*tarLinkEntry
+}
+
+type tarLinkEntry struct {
+	ch   chan struct{}
+	once sync.Once
+}
+
+func newTarLinkTracker() *tarLinkTracker {
+	return &tarLinkTracker{entries: map[string]*tarLinkEntry{}}
+}
+
+func (t *tarLinkTracker) entry(path string) *tarLinkEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.entries[path]
+	if !ok {
+		e = &tarLinkEntry{ch: make(chan struct{})}
+		t.entries[path] = e
+	}
+	return e
+}
+
+func (t *tarLinkTracker) waiter(path string) <-chan struct{} { return t.entry(path).ch }
+
+func (t *tarLinkTracker) markDone(path string) {
+	e := t.entry(path)
+	e.once.Do(func() { close(e.ch) })
+}
+
+func extractPackageTarball(b *ui.Task, r io.Reader, dest string, strip int, fltr *filter.Filter) error {
 	tr := tar.NewReader(r)
+	links := newTarLinkTracker()
+	jobs, stop := newPool(workerCount())
+
+	fail := func(err error) error {
+		_ = stop()
+		return err
+	}
+
 	for {
 		hdr, err := tr.Next()
 		if errors.Is(err, io.EOF) {
 			break
 		} else if err != nil {
-			return errors.WithStack(err)
+			return fail(errors.WithStack(err))
 		}
 		mode := hdr.FileInfo().Mode() &^ 0077
-		destFile := makeDestPath(dest, hdr.Name, strip)
+		destFile, err := makeDestPath(dest, hdr.Name, strip)
+		if err != nil {
+			return fail(err)
+		}
 		if destFile == "" {
+			// Stripped away entirely; nothing will ever be created here, so
+			// unblock any hardlink job elsewhere in the archive that, however
+			// unlikely, ends up waiting on this exact (empty) key.
+			links.markDone(destFile)
+			continue
+		}
+		mode, skip := fltr.Apply(relEntryPath(dest, destFile), mode)
+		if skip {
+			// No job will ever run for this entry, so any hardlink elsewhere
+			// in the archive that targets it must not wait on it forever.
+			links.markDone(destFile)
 			continue
 		}
 		b.Tracef("  %s -> %s", hdr.Name, destFile)
-		err = os.MkdirAll(filepath.Dir(destFile), 0700)
-		if err != nil {
-			return errors.WithStack(err)
+		if err := os.MkdirAll(filepath.Dir(destFile), 0700); err != nil {
+			return fail(errors.WithStack(err))
 		}
+
 		switch {
 		case mode.IsDir():
-			err = os.MkdirAll(destFile, 0700)
-			if err != nil {
-				return errors.Wrapf(err, "%s: failed to create directory", destFile)
+			destFile := destFile
+			jobs <- func() error {
+				defer links.markDone(destFile)
+				return errors.Wrapf(os.MkdirAll(destFile, 0700), "%s: failed to create directory", destFile)
 			}
 
 		case mode&os.ModeSymlink != 0:
-			err = syscall.Symlink(hdr.Linkname, destFile)
-			if err != nil {
-				return errors.Wrapf(err, "%s: failed to create symlink to %s", destFile, hdr.Linkname)
+			if err := validateSymlinkTarget(dest, destFile, hdr.Linkname); err != nil {
+				return fail(err)
+			}
+			destFile, linkname := destFile, hdr.Linkname
+			jobs <- func() error {
+				defer links.markDone(destFile)
+				return errors.Wrapf(syscall.Symlink(linkname, destFile), "%s: failed to create symlink to %s", destFile, linkname)
 			}
 
 		case hdr.Typeflag&(tar.TypeLink|tar.TypeGNULongLink) != 0 && hdr.Linkname != "":
 			// Convert hard links into symlinks so we don't have to track inodes later on during relocation.
-			src := filepath.Join(dest, hdr.Linkname) // nolint: gosec
-			rp, err := filepath.Rel(filepath.Dir(destFile), src)
+			src, err := safeJoin(dest, hdr.Linkname)
 			if err != nil {
-				return errors.WithStack(err)
+				return fail(err)
 			}
-			err = os.Symlink(rp, destFile)
+			rp, err := filepath.Rel(filepath.Dir(destFile), src)
 			if err != nil {
-				return errors.WithStack(err)
+				return fail(errors.WithStack(err))
+			}
+			destFile := destFile
+			ready := links.waiter(src)
+			jobs <- func() error {
+				defer links.markDone(destFile)
+				<-ready // wait for the target file this will point at to exist.
+				return errors.WithStack(os.Symlink(rp, destFile))
 			}
 
 		default:
-			err := os.MkdirAll(filepath.Dir(destFile), 0700)
+			staged, err := stageTarEntry(tr, hdr.Size)
 			if err != nil {
-				return errors.WithStack(err)
+				return fail(err)
 			}
-			w, err := os.OpenFile(destFile, os.O_CREATE|os.O_WRONLY, mode)
-			if err != nil {
-				return errors.WithStack(err)
+			destFile, mode := destFile, mode
+			atime, mtime := hdr.AccessTime, hdr.ModTime
+			jobs <- func() error {
+				defer links.markDone(destFile)
+				if err := staged.writeTo(destFile, mode); err != nil {
+					return err
+				}
+				_ = os.Chtimes(destFile, atime, mtime) // Best effort.
+				return nil
 			}
-			_, err = io.Copy(w, tr) // nolint: gosec
-			_ = w.Close()
-			if err != nil {
-				return errors.WithStack(err)
-			}
-			_ = os.Chtimes(destFile, hdr.AccessTime, hdr.ModTime) // Best effort.
 		}
 	}
-	return nil
+	return stop()
 }
 
 func extractDebianPackage(b *ui.Task, r io.Reader, dest string, pkg *manifest.Package) error {
@@ -438,7 +769,10 @@ func extractDebianPackage(b *ui.Task, r io.Reader, dest string, pkg *manifest.Pa
 			if err != nil {
 				return errors.WithStack(err)
 			}
-			filename := filepath.Join(dest, header.Name)
+			filename, err := safeJoin(dest, header.Name)
+			if err != nil {
+				return err
+			}
 			err = ioutil.WriteFile(filename, bytes, 0600)
 			if err != nil {
 				return errors.WithStack(err)
@@ -448,7 +782,7 @@ func extractDebianPackage(b *ui.Task, r io.Reader, dest string, pkg *manifest.Pa
 	}
 }
 
-func extract7Zip(r io.ReaderAt, size int64, dest string, strip int) error {
+func extract7Zip(r io.ReaderAt, size int64, dest string, strip int, fltr *filter.Filter) error {
 	sz, err := go7z.NewReader(r, size)
 	if err != nil {
 		return errors.WithStack(err)
@@ -468,19 +802,26 @@ func extract7Zip(r io.ReaderAt, size int64, dest string, strip int) error {
 		if hdr.IsEmptyStream && !hdr.IsEmptyFile {
 			continue
 		}
-		destFile := makeDestPath(dest, hdr.Name, strip)
+		destFile, err := makeDestPath(dest, hdr.Name, strip)
+		if err != nil {
+			return err
+		}
 		if destFile == "" {
 			continue
 		}
+		mode, skip := fltr.Apply(relEntryPath(dest, destFile), 0755)
+		if skip {
+			continue
+		}
 		err = ensureDirExists(destFile)
 		if err != nil {
 			return errors.WithStack(err)
 		}
 
 		// Create file
-		f, err := os.OpenFile(destFile, os.O_CREATE|os.O_RDWR, 0755) // nolint: gosec
+		f, err := createRegularFile(destFile, mode)
 		if err != nil {
-			return errors.WithStack(err)
+			return err
 		}
 
 		if _, err := io.Copy(f, sz); err != nil {
@@ -495,6 +836,7 @@ func extract7Zip(r io.ReaderAt, size int64, dest string, strip int) error {
 }
 
 func extractRpmPackage(r io.Reader, dest string, pkg *manifest.Package) error {
+	fltr := filterFor(pkg)
 	rpm, err := rpmutils.ReadRpm(r)
 	if err != nil {
 		return errors.WithStack(err)
@@ -517,15 +859,22 @@ func extractRpmPackage(r io.Reader, dest string, pkg *manifest.Package) error {
 			if err != nil {
 				return errors.WithStack(err)
 			}
-			filename := makeDestPath(dest, header.Filename(), pkg.Strip)
+			filename, err := makeDestPath(dest, header.Filename(), pkg.Strip)
+			if err != nil {
+				return err
+			}
 			if filename == "" {
 				continue
 			}
+			mode, skip := fltr.Apply(relEntryPath(dest, filename), os.FileMode(header.Mode()))
+			if skip {
+				continue
+			}
 			err = ensureDirExists(filename)
 			if err != nil {
 				return errors.WithStack(err)
 			}
-			err = ioutil.WriteFile(filename, bts, os.FileMode(header.Mode()))
+			err = ioutil.WriteFile(filename, bts, mode)
 			if err != nil {
 				return errors.WithStack(err)
 			}
@@ -539,13 +888,14 @@ func ensureDirExists(file string) error {
 	return os.MkdirAll(dir, os.ModePerm)
 }
 
-// Strip leading path component.
-func makeDestPath(dest, path string, strip int) string {
+// makeDestPath strips the leading "strip" path components from "path" (an
+// archive entry name) and safely joins what remains onto dest. It returns
+// ("", nil) if stripping consumes the whole path, and a non-nil error if
+// the entry would escape dest (a "Zip Slip").
+func makeDestPath(dest, path string, strip int) (string, error) {
 	parts := strings.Split(path, "/")
 	if len(parts) <= strip {
-		return ""
+		return "", nil
 	}
-	destFile := strings.Join(parts[strip:], "/")
-	destFile = filepath.Join(dest, destFile)
-	return destFile
+	return safeJoin(dest, strings.Join(parts[strip:], "/"))
 }
@@ -0,0 +1,47 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/cashapp/hermit/archive/filter"
+	"github.com/cashapp/hermit/ui"
+)
+
+// A hardlink whose target entry is skipped by an exclude filter must not
+// block the worker pool forever: a filtered-out entry never reaches a job,
+// so its skip path must markDone() it instead of the job that would have
+// written it.
+func TestExtractPackageTarballExcludedHardlinkTargetDoesNotDeadlock(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require := func(err error) {
+		if err != nil {
+			t.Fatalf("building fixture tarball: %v", err)
+		}
+	}
+	require(tw.WriteHeader(&tar.Header{Name: "doc.txt", Mode: 0644, Size: 5, Typeflag: tar.TypeReg}))
+	_, err := tw.Write([]byte("hello"))
+	require(err)
+	require(tw.WriteHeader(&tar.Header{Name: "doc2.txt", Linkname: "doc.txt", Typeflag: tar.TypeLink}))
+	require(tw.Close())
+
+	dest := t.TempDir()
+	fltr := filter.New(nil, []string{"doc.txt"}, nil)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- extractPackageTarball(&ui.Task{}, &buf, dest, 0, fltr)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("extractPackageTarball deadlocked on excluded hardlink target")
+	}
+}
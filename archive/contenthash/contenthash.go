@@ -0,0 +1,170 @@
+// Package contenthash computes a stable, recursive digest of an extracted
+// directory tree.
+//
+// The approach mirrors buildkit's contenthash package: every path in the
+// tree gets an entry in an in-memory map keyed by its cleaned, absolute
+// unix-style path, holding the digest of that entry alone. For directories
+// the recursive digest of their contents is then computed by hashing the
+// sorted concatenation of (basename, childDigest) pairs. The root digest is
+// simply the recursive digest of "/".
+//
+// Because the digest is built purely from path, mode, ownership, size and
+// content (never timestamps), two unpacks of the same archive on different
+// machines produce an identical digest. This lets callers detect local
+// tampering of an installed package, and in future will let hermit dedupe
+// identical unpacks across manifests.
+package contenthash
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// Digest is a hex-encoded sha256 digest, prefixed with its algorithm for
+// future-proofing, eg. "sha256:deadbeef...".
+type Digest string
+
+// entry is the digest of a single path, plus (for directories) the memoised
+// digest of everything underneath it.
+type entry struct {
+	header   Digest
+	isDir    bool
+	children Digest // only set (and only meaningful) for directories
+}
+
+// Checksum walks "root" and returns the recursive digest of the whole tree.
+//
+// The returned digest changes if any file's content, mode, uid or gid
+// changes, if any symlink's target changes, or if any path is added,
+// removed or renamed.
+func Checksum(root string) (Digest, error) {
+	root = filepath.Clean(root)
+	entries := map[string]*entry{}
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if rel == "." {
+			rel = ""
+		}
+		key := "/" + filepath.ToSlash(rel)
+		h, err := headerDigest(p, info)
+		if err != nil {
+			return errors.Wrap(err, p)
+		}
+		entries[key] = &entry{header: h, isDir: info.IsDir()}
+		return nil
+	})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	children := childrenOf(entries)
+	return recursiveDigest(entries, children, "/"), nil
+}
+
+// Verify recomputes the digest of "root" and compares it against "expected".
+func Verify(root string, expected Digest) error {
+	actual, err := Checksum(root)
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return errors.Errorf("tree digest mismatch for %s: expected %s, got %s", root, expected, actual)
+	}
+	return nil
+}
+
+// headerDigest hashes the metadata (and, for regular files, the content)
+// that identifies a single entry.
+func headerDigest(p string, info os.FileInfo) (Digest, error) {
+	h := sha256.New()
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(p)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		fmt.Fprintf(h, "%d:%s", info.Mode(), link)
+
+	case info.IsDir():
+		fmt.Fprintf(h, "%d:%s", info.Mode(), filepath.Base(p))
+
+	default:
+		uid, gid := ownership(info)
+		fmt.Fprintf(h, "%d:%d:%d:%d:", info.Mode(), uid, gid, info.Size())
+		f, err := os.Open(p) // nolint: gosec
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		defer f.Close() // nolint: errcheck
+		if _, err := io.Copy(h, f); err != nil {
+			return "", errors.WithStack(err)
+		}
+	}
+	return Digest("sha256:" + hex.EncodeToString(h.Sum(nil))), nil
+}
+
+// childrenOf groups entry keys by their immediate parent directory.
+func childrenOf(entries map[string]*entry) map[string][]string {
+	children := map[string][]string{}
+	for p := range entries {
+		if p == "/" {
+			continue
+		}
+		parent := path.Dir(p)
+		children[parent] = append(children[parent], p)
+	}
+	return children
+}
+
+// recursiveDigest computes (and memoises) the digest of "dir" and everything
+// beneath it.
+func recursiveDigest(entries map[string]*entry, children map[string][]string, dir string) Digest {
+	e := entries[dir]
+	if e != nil && e.children != "" {
+		return e.children
+	}
+	kids := children[dir]
+	sort.Strings(kids)
+
+	h := sha256.New()
+	for _, p := range kids {
+		ce := entries[p]
+		if ce.isDir {
+			// Fold the directory's own header digest (which captures its
+			// mode) in alongside its contents digest, so eg. a chmod of a
+			// subdirectory changes its parent's digest even though none of
+			// its children changed.
+			fmt.Fprintf(h, "%s:%s:%s\n", path.Base(p), ce.header, recursiveDigest(entries, children, p))
+			continue
+		}
+		fmt.Fprintf(h, "%s:%s\n", path.Base(p), ce.header)
+	}
+	digest := Digest("sha256:" + hex.EncodeToString(h.Sum(nil)))
+	if e == nil {
+		e = &entry{isDir: true}
+		entries[dir] = e
+	}
+	e.children = digest
+	return digest
+}
+
+func ownership(info os.FileInfo) (uid, gid uint32) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Uid, stat.Gid
+	}
+	return 0, 0
+}
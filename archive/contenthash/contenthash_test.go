@@ -0,0 +1,68 @@
+package contenthash
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTree(t *testing.T, root string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "bin"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "bin", "tool"), []byte("#!/bin/sh\necho hi\n"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "README.md"), []byte("hello"), 0644))
+	require.NoError(t, os.Symlink("tool", filepath.Join(root, "bin", "tool-alias")))
+}
+
+func TestChecksumStable(t *testing.T) {
+	a, b := t.TempDir(), t.TempDir()
+	writeTree(t, a)
+	writeTree(t, b)
+
+	da, err := Checksum(a)
+	require.NoError(t, err)
+	db, err := Checksum(b)
+	require.NoError(t, err)
+	assert.Equal(t, da, db)
+}
+
+func TestChecksumDetectsContentChange(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root)
+	before, err := Checksum(root)
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "README.md"), []byte("tampered"), 0644))
+
+	after, err := Checksum(root)
+	require.NoError(t, err)
+	assert.NotEqual(t, before, after)
+}
+
+func TestChecksumDetectsDirectoryModeChange(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root)
+	before, err := Checksum(root)
+	require.NoError(t, err)
+
+	require.NoError(t, os.Chmod(filepath.Join(root, "bin"), 0777))
+
+	after, err := Checksum(root)
+	require.NoError(t, err)
+	assert.NotEqual(t, before, after)
+}
+
+func TestVerify(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root)
+	digest, err := Checksum(root)
+	require.NoError(t, err)
+	assert.NoError(t, Verify(root, digest))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "README.md"), []byte("tampered"), 0644))
+	assert.Error(t, Verify(root, digest))
+}
@@ -0,0 +1,49 @@
+package archive
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cashapp/hermit/manifest"
+	"github.com/cashapp/hermit/ui"
+)
+
+func writeTestTarball(t *testing.T, path string) {
+	t.Helper()
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close() // nolint: errcheck
+	tw := tar.NewWriter(f)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "file.txt", Mode: 0644, Size: 5, Typeflag: tar.TypeReg}))
+	_, err = tw.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+}
+
+// TestExtractRejectsMismatchedDigest is a regression test for the named
+// return "err" being shadowed by a ":=" inside Extract's finalizing defer:
+// that shadowing meant a mismatched pkg.Digest was reported, logged, and
+// then silently discarded, so Extract returned nil instead of failing.
+func TestExtractRejectsMismatchedDigest(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "pkg.tar")
+	writeTestTarball(t, source)
+
+	dest := filepath.Join(dir, "installed")
+	pkg := &manifest.Package{Dest: dest, Source: source, Digest: "sha256:0000000000000000000000000000000000000000000000000000000000000000"}
+
+	err := Extract(&ui.Task{}, source, pkg)
+	require.Error(t, err)
+	assert.NoDirExists(t, dest)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, e := range entries {
+		assert.Equal(t, "pkg.tar", e.Name(), "Extract must not leave a leaked tmpDest behind on digest mismatch")
+	}
+}
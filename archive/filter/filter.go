@@ -0,0 +1,121 @@
+// Package filter implements the gitignore-style include/exclude and mode
+// rewrite rules that can be attached to a manifest's extract{} block, so
+// that extractZip, extractPackageTarball, extract7Zip and extractRpmPackage
+// all behave consistently.
+package filter
+
+import (
+	"os"
+	"path"
+	"strings"
+)
+
+// ChmodRule forces the mode of any extracted entry matching Pattern to Mode,
+// overriding whatever mode the archive itself records. This is used in
+// preference to the blanket "&^0077" mask that extractors otherwise apply,
+// for the handful of entries (eg. wrapper scripts generated without the
+// executable bit) that need a specific mode regardless of what's on disk in
+// the upstream archive.
+type ChmodRule struct {
+	Pattern string
+	Mode    os.FileMode
+}
+
+// Filter decides, for each entry in an archive, whether it should be
+// extracted at all and what mode it should be extracted with.
+//
+// A nil *Filter is valid and extracts everything unchanged, so callers with
+// no extract{} block configured can construct one with New(nil, nil, nil)
+// and apply it unconditionally.
+type Filter struct {
+	include []string
+	exclude []string
+	chmod   []ChmodRule
+}
+
+// New builds a Filter from the Include, Exclude and ChmodRules of a
+// manifest's extract{} block. All three are optional.
+func New(include, exclude []string, chmod []ChmodRule) *Filter {
+	return &Filter{include: include, exclude: exclude, chmod: chmod}
+}
+
+// Apply decides whether "entryPath" (the archive-relative path, after strip,
+// using forward slashes) should be extracted, and what mode it should be
+// extracted with.
+//
+// Excludes always win over includes: an entry matching both is skipped. An
+// entry is skipped if Include rules are configured and it matches none of
+// them. Otherwise the first matching ChmodRule, if any, overrides "mode".
+func (f *Filter) Apply(entryPath string, mode os.FileMode) (outMode os.FileMode, skip bool) {
+	if f == nil {
+		return mode, false
+	}
+	entryPath = strings.TrimPrefix(entryPath, "/")
+	for _, pattern := range f.exclude {
+		if matches(pattern, entryPath) {
+			return mode, true
+		}
+	}
+	if len(f.include) > 0 {
+		included := false
+		for _, pattern := range f.include {
+			if matches(pattern, entryPath) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return mode, true
+		}
+	}
+	for _, rule := range f.chmod {
+		if matches(rule.Pattern, entryPath) {
+			// Only the permission bits are overridden; the entry's type
+			// (directory, symlink, ...) is never touched by a chmod rule.
+			return (mode &^ os.ModePerm) | (rule.Mode & os.ModePerm), false
+		}
+	}
+	return mode, false
+}
+
+// matches reports whether "entryPath" matches the gitignore-style glob
+// "pattern". Patterns without a "/" are matched against the entry's
+// basename only, so eg. "*.md" excludes markdown files at any depth.
+// Patterns containing a "/" are matched segment by segment against the
+// whole path, where a "**" segment matches zero or more path segments --
+// so eg. "**/test/**" matches a "test" directory, and everything under it,
+// at any depth.
+func matches(pattern, entryPath string) bool {
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(entryPath))
+		return ok
+	}
+	patternSegs := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	entrySegs := strings.Split(entryPath, "/")
+	return matchSegments(patternSegs, entrySegs)
+}
+
+// matchSegments matches a pattern against a path one path-separator-delimited
+// segment at a time, treating a "**" pattern segment as matching zero or
+// more path segments.
+func matchSegments(pattern, entry []string) bool {
+	if len(pattern) == 0 {
+		return len(entry) == 0
+	}
+	if pattern[0] == "**" {
+		if matchSegments(pattern[1:], entry) {
+			return true
+		}
+		if len(entry) == 0 {
+			return false
+		}
+		return matchSegments(pattern, entry[1:])
+	}
+	if len(entry) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], entry[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], entry[1:])
+}
@@ -0,0 +1,74 @@
+package filter
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyNilFilter(t *testing.T) {
+	var f *Filter
+	mode, skip := f.Apply("bin/tool", 0644)
+	assert.False(t, skip)
+	assert.Equal(t, os.FileMode(0644), mode)
+}
+
+func TestApplyExclude(t *testing.T) {
+	f := New(nil, []string{"*.md", "docs/*"}, nil)
+	_, skip := f.Apply("README.md", 0644)
+	assert.True(t, skip)
+	_, skip = f.Apply("docs/guide.txt", 0644)
+	assert.True(t, skip)
+	_, skip = f.Apply("bin/tool", 0755)
+	assert.False(t, skip)
+}
+
+func TestApplyIncludeOnly(t *testing.T) {
+	f := New([]string{"bin/*"}, nil, nil)
+	_, skip := f.Apply("bin/tool", 0755)
+	assert.False(t, skip)
+	_, skip = f.Apply("README.md", 0644)
+	assert.True(t, skip)
+}
+
+func TestExcludeWinsOverInclude(t *testing.T) {
+	f := New([]string{"bin/*"}, []string{"bin/internal-*"}, nil)
+	_, skip := f.Apply("bin/internal-helper", 0755)
+	assert.True(t, skip)
+	_, skip = f.Apply("bin/tool", 0755)
+	assert.False(t, skip)
+}
+
+func TestApplyChmodRule(t *testing.T) {
+	f := New(nil, nil, []ChmodRule{{Pattern: "bin/*", Mode: 0755}})
+	mode, skip := f.Apply("bin/tool", 0644)
+	assert.False(t, skip)
+	assert.Equal(t, os.FileMode(0755), mode)
+
+	mode, skip = f.Apply("README.md", 0644)
+	assert.False(t, skip)
+	assert.Equal(t, os.FileMode(0644), mode)
+}
+
+func TestApplyDoubleStarMatchesAnyDepth(t *testing.T) {
+	f := New(nil, []string{"**/test/**"}, nil)
+	_, skip := f.Apply("test/fixture.txt", 0644)
+	assert.True(t, skip)
+	_, skip = f.Apply("src/pkg/test/fixture.txt", 0644)
+	assert.True(t, skip)
+	_, skip = f.Apply("src/pkg/test/nested/deep/fixture.txt", 0644)
+	assert.True(t, skip)
+	_, skip = f.Apply("src/pkg/testing/fixture.txt", 0644)
+	assert.False(t, skip)
+}
+
+func TestApplyDoubleStarAtStart(t *testing.T) {
+	f := New(nil, []string{"**/*.md"}, nil)
+	_, skip := f.Apply("README.md", 0644)
+	assert.True(t, skip)
+	_, skip = f.Apply("docs/guide/README.md", 0644)
+	assert.True(t, skip)
+	_, skip = f.Apply("docs/guide/README.txt", 0644)
+	assert.False(t, skip)
+}
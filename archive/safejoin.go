@@ -0,0 +1,114 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// safeJoin resolves an archive entry's path against dest the way
+// cyphar/filepath-securejoin's SecureJoin does: it walks entryPath one
+// component at a time, following any symlink it encounters (resolving a
+// relative target from the symlink's own directory within dest, never
+// through the host filesystem; an absolute target is refused), and refuses
+// to produce a
+// path outside dest -- whether that's because entryPath is itself absolute,
+// contains a ".." that climbs above dest, or traverses a symlink that
+// points outside dest.
+//
+// Every extractor must route entry paths (and tar hardlink/symlink
+// targets) through safeJoin rather than filepath.Join, so a malicious zip,
+// tar, rpm or deb can't write outside pkg.Dest (a "Zip Slip").
+func safeJoin(dest, entryPath string) (string, error) {
+	unsafe := filepath.FromSlash(entryPath)
+	if filepath.IsAbs(unsafe) {
+		return "", errors.Errorf("refusing to extract absolute path %q", entryPath)
+	}
+
+	current := dest
+	remaining := unsafe
+	for remaining != "" {
+		var component string
+		if i := strings.IndexRune(remaining, filepath.Separator); i >= 0 {
+			component, remaining = remaining[:i], remaining[i+1:]
+		} else {
+			component, remaining = remaining, ""
+		}
+
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			if current == dest {
+				return "", errors.Errorf("entry %q attempts to escape destination %q", entryPath, dest)
+			}
+			current = filepath.Dir(current)
+			continue
+		}
+
+		next := filepath.Join(current, component)
+		info, err := os.Lstat(next)
+		if err != nil {
+			// Doesn't exist (yet) -- nothing to resolve, just descend; the
+			// caller will create it.
+			current = next
+			continue
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+
+		link, err := os.Readlink(next)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		if filepath.IsAbs(link) {
+			return "", errors.Errorf("entry %q traverses absolute symlink %q -> %q", entryPath, next, link)
+		}
+		// Resolve the target from the symlink's own directory, but confine
+		// it to dest rather than to that directory.
+		linkDir, err := filepath.Rel(dest, current)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		resolved, err := safeJoin(dest, filepath.Join(linkDir, link))
+		if err != nil {
+			return "", errors.Wrapf(err, "entry %q traverses symlink %q", entryPath, next)
+		}
+		current = resolved
+	}
+
+	if current != dest && !strings.HasPrefix(current, dest+string(filepath.Separator)) {
+		return "", errors.Errorf("entry %q escapes destination %q", entryPath, dest)
+	}
+	return current, nil
+}
+
+// validateSymlinkTarget rejects a symlink entry whose target, once resolved
+// relative to its own location, would point outside dest. Unlike safeJoin
+// this doesn't need the target to exist yet -- it's pure path arithmetic --
+// but it shares the same "must stay inside dest" rule.
+func validateSymlinkTarget(dest, destFile, linkname string) error {
+	target := linkname
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(destFile), filepath.FromSlash(linkname))
+	}
+	target = filepath.Clean(target)
+	if target != dest && !strings.HasPrefix(target, dest+string(filepath.Separator)) {
+		return errors.Errorf("symlink %q -> %q escapes destination %q", destFile, linkname, dest)
+	}
+	return nil
+}
+
+// createRegularFile opens destFile for writing a regular archive entry,
+// refusing to follow a pre-existing symlink at the leaf -- on a filesystem
+// shared with other extractions, an earlier entry (or a racing process)
+// could otherwise have planted a symlink at destFile pointing outside dest.
+func createRegularFile(destFile string, mode os.FileMode) (*os.File, error) {
+	f, err := os.OpenFile(destFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|syscall.O_NOFOLLOW, mode) // nolint: gosec
+	return f, errors.WithStack(err)
+}
@@ -0,0 +1,121 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSafeJoinRejectsAbsolutePath(t *testing.T) {
+	dest := t.TempDir()
+	_, err := safeJoin(dest, "/etc/passwd")
+	assert.Error(t, err)
+}
+
+func TestSafeJoinRejectsParentTraversal(t *testing.T) {
+	dest := t.TempDir()
+	_, err := safeJoin(dest, "../../etc/passwd")
+	assert.Error(t, err)
+}
+
+func TestSafeJoinRejectsTraversalThatDipsBackIn(t *testing.T) {
+	dest := t.TempDir()
+	_, err := safeJoin(dest, "a/../../b")
+	assert.Error(t, err)
+}
+
+func TestSafeJoinAllowsOrdinaryPaths(t *testing.T) {
+	dest := t.TempDir()
+	got, err := safeJoin(dest, "a/b/c.txt")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dest, "a", "b", "c.txt"), got)
+}
+
+func TestSafeJoinFollowsSymlinkThenFile(t *testing.T) {
+	dest := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dest, "real"), 0700))
+	require.NoError(t, os.Symlink("real", filepath.Join(dest, "link")))
+
+	got, err := safeJoin(dest, "link/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dest, "real", "file.txt"), got)
+}
+
+func TestSafeJoinRejectsSymlinkEscapingDest(t *testing.T) {
+	dest := t.TempDir()
+	outside := t.TempDir()
+	require.NoError(t, os.Symlink(outside, filepath.Join(dest, "link")))
+
+	_, err := safeJoin(dest, "link/file.txt")
+	assert.Error(t, err)
+}
+
+func TestSafeJoinRejectsAbsoluteSymlinkTarget(t *testing.T) {
+	dest := t.TempDir()
+	require.NoError(t, os.Symlink("/etc", filepath.Join(dest, "link")))
+
+	_, err := safeJoin(dest, "link/passwd")
+	assert.Error(t, err)
+}
+
+func TestValidateSymlinkTargetAllowsSiblingTarget(t *testing.T) {
+	dest := t.TempDir()
+	destFile := filepath.Join(dest, "bin", "tool")
+	assert.NoError(t, validateSymlinkTarget(dest, destFile, "../lib/tool.so"))
+}
+
+func TestValidateSymlinkTargetRejectsEscapingTarget(t *testing.T) {
+	dest := t.TempDir()
+	destFile := filepath.Join(dest, "bin", "tool")
+	assert.Error(t, validateSymlinkTarget(dest, destFile, "../../etc/passwd"))
+}
+
+func TestValidateSymlinkTargetRejectsAbsoluteTarget(t *testing.T) {
+	dest := t.TempDir()
+	destFile := filepath.Join(dest, "bin", "tool")
+	assert.Error(t, validateSymlinkTarget(dest, destFile, "/etc/passwd"))
+}
+
+// FuzzSafeJoin exercises safeJoin with crafted entry paths -- "../" climbs,
+// absolute paths, and symlink-then-file sequences -- checking only the
+// invariant that matters: safeJoin never returns a path outside dest.
+func FuzzSafeJoin(f *testing.F) {
+	seeds := []string{
+		"a/b/c",
+		"../../../etc/passwd",
+		"/etc/passwd",
+		"a/../../b",
+		"link/../../escape",
+		"a/b/../../../../c",
+		"....//....//etc/passwd",
+		"a/./b/./c",
+	}
+	for _, s := range seeds {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, entryPath string) {
+		dest := t.TempDir()
+		require.NoError(t, os.Mkdir(filepath.Join(dest, "real"), 0700))
+		require.NoError(t, os.Symlink("real", filepath.Join(dest, "link")))
+
+		got, err := safeJoin(dest, entryPath)
+		if err != nil {
+			return
+		}
+		if got != dest && !hasPathPrefix(got, dest) {
+			t.Fatalf("safeJoin(%q, %q) = %q escapes dest %q", dest, entryPath, got, dest)
+		}
+	})
+}
+
+func hasPathPrefix(path, dest string) bool {
+	rel, err := filepath.Rel(dest, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
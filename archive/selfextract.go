@@ -0,0 +1,181 @@
+package archive
+
+import (
+	"archive/zip"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"io"
+	"os"
+	"path"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/pkg/errors"
+
+	"github.com/cashapp/hermit/manifest"
+	"github.com/cashapp/hermit/ui"
+)
+
+// archiveOffset is a candidate byte offset at which a self-extracting
+// executable's archive payload might start.
+type archiveOffset struct {
+	offset int64
+	// truncateHost is true only for the "appended after everything loaded"
+	// candidate, where the host executable is exactly the bytes preceding
+	// offset. Section-embedded candidates may have legitimate file content
+	// -- eg. the section header table itself -- after the payload, so their
+	// host executable must be the complete original file rather than a
+	// prefix truncated at offset.
+	truncateHost bool
+}
+
+// trailingArchiveOffsets returns candidate offsets, in order of likelihood,
+// at which a self-extracting executable's archive payload might start. The
+// first candidate is always the offset immediately after the highest loaded
+// section/segment, which is where `cat host.bin payload.zip > installer`
+// style toolchains append it. For ELF and PE, the remaining candidates are
+// the start of every other section that occupies bytes in the file (for
+// ELF, every section that isn't SHT_NOBITS), since some toolchains embed the
+// payload inside a section instead. Mach-O has only the first candidate.
+func trailingArchiveOffsets(f *os.File, mimeStr string) ([]archiveOffset, error) {
+	switch mimeStr {
+	case "application/x-elf", "application/x-executable", "application/x-sharedlib":
+		ef, err := elf.NewFile(f)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		defer ef.Close() // nolint: errcheck
+		var end int64
+		for _, sec := range ef.Sections {
+			if sec.Type == elf.SHT_NOBITS {
+				continue
+			}
+			if off := int64(sec.Offset + sec.Size); off > end {
+				end = off
+			}
+		}
+		offsets := []archiveOffset{{offset: end, truncateHost: true}}
+		for _, sec := range ef.Sections {
+			if sec.Type == elf.SHT_NOBITS || int64(sec.Offset) == end {
+				continue
+			}
+			offsets = append(offsets, archiveOffset{offset: int64(sec.Offset)})
+		}
+		return offsets, nil
+
+	case "application/x-mach-binary":
+		mf, err := macho.NewFile(f)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		defer mf.Close() // nolint: errcheck
+		var end int64
+		for _, sec := range mf.Sections {
+			if off := int64(sec.Offset) + int64(sec.Size); off > end {
+				end = off
+			}
+		}
+		return []archiveOffset{{offset: end, truncateHost: true}}, nil
+
+	case "application/vnd.microsoft.portable-executable":
+		pf, err := pe.NewFile(f)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		defer pf.Close() // nolint: errcheck
+		var end int64
+		var sections []int64
+		for _, sec := range pf.Sections {
+			if off := int64(sec.Offset) + int64(sec.Size); off > end {
+				end = off
+			}
+			sections = append(sections, int64(sec.Offset))
+		}
+		offsets := []archiveOffset{{offset: end, truncateHost: true}}
+		for _, off := range sections {
+			if off == end {
+				continue
+			}
+			offsets = append(offsets, archiveOffset{offset: off})
+		}
+		return offsets, nil
+
+	default:
+		return nil, nil
+	}
+}
+
+// extractExecutableOrSelfExtracting writes out a plain executable, unless it
+// detects that "source" is actually a self-extracting archive -- a zip or
+// tar payload appended to (or embedded within a section of) an ELF,
+// Mach-O, or PE executable, as used by many single-file installers (Java
+// installers, some Go/Rust tools, JetBrains launchers). In that case the
+// host executable is written to tmpDest under pkg.Source's basename, as
+// usual, and the payload is extracted alongside it.
+func extractExecutableOrSelfExtracting(b *ui.Task, f *os.File, r io.Reader, info os.FileInfo, tmpDest string, pkg *manifest.Package, mimeStr string) error {
+	offsets, err := trailingArchiveOffsets(f, mimeStr)
+	if err != nil {
+		b.Tracef("%s: could not probe for appended archive: %s", pkg.Source, err)
+		offsets = nil
+	}
+	for _, candidate := range offsets {
+		if candidate.offset <= 0 || candidate.offset >= info.Size() {
+			continue
+		}
+		if err := extractAppendedArchiveAt(b, f, candidate, info.Size(), tmpDest, pkg); err == nil {
+			return nil
+		} else if !errors.Is(err, errNoAppendedArchive) {
+			return err
+		}
+	}
+	return extractExecutable(r, tmpDest, path.Base(pkg.Source))
+}
+
+var errNoAppendedArchive = errors.New("no archive payload found at offset")
+
+// extractAppendedArchiveAt attempts to interpret the bytes at
+// [candidate.offset, size) of f as a zip or tar archive. If it finds one, it
+// writes the host executable and unpacks the archive; otherwise it returns
+// errNoAppendedArchive so the caller can try the next candidate offset.
+func extractAppendedArchiveAt(b *ui.Task, f *os.File, candidate archiveOffset, size int64, tmpDest string, pkg *manifest.Package) error {
+	offset := candidate.offset
+	tail := io.NewSectionReader(f, offset, size-offset)
+	if zr, err := zip.NewReader(tail, size-offset); err == nil {
+		if err := writeHostExecutable(f, tmpDest, path.Base(pkg.Source), offset, size, candidate.truncateHost); err != nil {
+			return err
+		}
+		b.Debugf("found appended zip payload at offset %d", offset)
+		return extractZipReader(b, zr, tmpDest, pkg.Strip, filterFor(pkg))
+	}
+
+	sniff := make([]byte, 4096)
+	n, err := tail.ReadAt(sniff, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return errors.WithStack(err)
+	}
+	if mimetype.Detect(sniff[:n]).Is("application/x-tar") {
+		if err := writeHostExecutable(f, tmpDest, path.Base(pkg.Source), offset, size, candidate.truncateHost); err != nil {
+			return err
+		}
+		b.Debugf("found appended tar payload at offset %d", offset)
+		return extractPackageTarball(b, io.NewSectionReader(f, offset, size-offset), tmpDest, pkg.Strip, filterFor(pkg))
+	}
+	return errNoAppendedArchive
+}
+
+// writeHostExecutable writes the host executable portion of f into dest.
+// When truncate is set (the "appended after everything loaded" candidate),
+// that's exactly the first "offset" bytes. Otherwise -- a section-embedded
+// payload, which may have legitimate file content such as the section
+// header table after it -- truncating at offset would throw that trailing
+// content away, so the complete original file is written instead.
+func writeHostExecutable(f *os.File, dest, name string, offset, size int64, truncate bool) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return errors.WithStack(err)
+	}
+	limit := size
+	if truncate {
+		limit = offset
+	}
+	return extractExecutable(io.LimitReader(f, limit), dest, name)
+}
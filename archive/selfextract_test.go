@@ -0,0 +1,136 @@
+package archive
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// buildSyntheticELF assembles a minimal, valid ELF64 file with three
+// sections -- .text, .shstrtab and .payload -- followed by trailing bytes
+// that don't belong to any section (standing in for, eg., a section header
+// table placed by a real toolchain after an embedded payload), and finally
+// the section header table itself. It returns the full file bytes along
+// with the byte offsets of the .text and .payload sections' declared
+// contents, for the test to reason about.
+func buildSyntheticELF(t *testing.T) (data []byte, textOffset, payloadOffset int64) {
+	t.Helper()
+	const (
+		textOff     = 64
+		textSize    = 16
+		shstrtabOff = textOff + textSize // 80
+		strtab      = "\x00.shstrtab\x00.text\x00.payload\x00"
+		payloadOff  = shstrtabOff + len(strtab) // 106
+		payloadSize = 8
+		trailerOff  = payloadOff + payloadSize // 114
+		trailerSize = 20
+		shoff       = trailerOff + trailerSize // 134
+		shentsize   = 64
+		shnum       = 4
+	)
+
+	buf := make([]byte, shoff+shentsize*shnum)
+
+	// e_ident
+	copy(buf[0:4], "\x7fELF")
+	buf[4] = 2 // ELFCLASS64
+	buf[5] = 1 // ELFDATA2LSB
+	buf[6] = 1 // EV_CURRENT
+	le := binary.LittleEndian
+	le.PutUint16(buf[16:], uint16(elf.ET_EXEC))
+	le.PutUint16(buf[18:], uint16(elf.EM_X86_64))
+	le.PutUint32(buf[20:], 1) // e_version
+	le.PutUint64(buf[40:], uint64(shoff))
+	le.PutUint16(buf[52:], 64)        // e_ehsize
+	le.PutUint16(buf[58:], shentsize) // e_shentsize
+	le.PutUint16(buf[60:], shnum)     // e_shnum
+	le.PutUint16(buf[62:], 2)         // e_shstrndx -- .shstrtab is section 2
+
+	copy(buf[textOff:], bytes.Repeat([]byte{0xcc}, textSize))
+	copy(buf[shstrtabOff:], strtab)
+	copy(buf[payloadOff:], bytes.Repeat([]byte{0x50}, payloadSize)) // 'P'
+	copy(buf[trailerOff:], bytes.Repeat([]byte{0xaa}, trailerSize))
+
+	putShdr := func(idx int, name, typ uint32, offset, size uint64) {
+		sh := buf[shoff+idx*shentsize:]
+		le.PutUint32(sh[0:], name)
+		le.PutUint32(sh[4:], typ)
+		le.PutUint64(sh[24:], offset)
+		le.PutUint64(sh[32:], size)
+		le.PutUint64(sh[48:], 1) // sh_addralign
+	}
+	// index 0: SHT_NULL, all zero -- left as-is.
+	putShdr(1, 11, uint32(elf.SHT_PROGBITS), uint64(textOff), uint64(textSize))       // .text
+	putShdr(2, 1, uint32(elf.SHT_STRTAB), uint64(shstrtabOff), uint64(len(strtab)))   // .shstrtab
+	putShdr(3, 17, uint32(elf.SHT_PROGBITS), uint64(payloadOff), uint64(payloadSize)) // .payload
+
+	return buf, int64(textOff), int64(payloadOff)
+}
+
+func TestTrailingArchiveOffsetsSectionEmbeddedCandidatesDontTruncate(t *testing.T) {
+	data, textOffset, payloadOffset := buildSyntheticELF(t)
+	path := filepath.Join(t.TempDir(), "host.elf")
+	require.NoError(t, os.WriteFile(path, data, 0600))
+	f, err := os.Open(path) // nolint: gosec
+	require.NoError(t, err)
+	defer f.Close() // nolint: errcheck
+
+	offsets, err := trailingArchiveOffsets(f, "application/x-elf")
+	require.NoError(t, err)
+	require.NotEmpty(t, offsets)
+
+	// The first candidate is the "appended after everything loaded" one,
+	// and is the only one that should ever truncate the host executable.
+	assert.True(t, offsets[0].truncateHost)
+
+	byOffset := map[int64]archiveOffset{}
+	for _, o := range offsets[1:] {
+		byOffset[o.offset] = o
+		assert.False(t, o.truncateHost, "section-embedded candidate at %d must not truncate the host", o.offset)
+	}
+	assert.Contains(t, byOffset, textOffset)
+	assert.Contains(t, byOffset, payloadOffset)
+}
+
+func TestWriteHostExecutableSectionEmbeddedWritesCompleteFile(t *testing.T) {
+	data, _, payloadOffset := buildSyntheticELF(t)
+	src := filepath.Join(t.TempDir(), "host.elf")
+	require.NoError(t, os.WriteFile(src, data, 0600))
+	f, err := os.Open(src) // nolint: gosec
+	require.NoError(t, err)
+	defer f.Close() // nolint: errcheck
+
+	dest := t.TempDir()
+	require.NoError(t, writeHostExecutable(f, dest, "host", payloadOffset, int64(len(data)), false))
+
+	got, err := os.ReadFile(filepath.Join(dest, "host"))
+	require.NoError(t, err)
+	// Truncating at the section offset would have thrown away everything
+	// from payloadOffset onwards, including the trailing bytes that don't
+	// belong to the payload (eg. a section header table placed after it).
+	assert.Equal(t, data, got, "section-embedded candidate must write the complete original file, not a prefix truncated at the section offset")
+}
+
+func TestWriteHostExecutableAppendedTruncatesAtOffset(t *testing.T) {
+	data, _, _ := buildSyntheticELF(t)
+	appendedOffset := int64(len(data))
+	data = append(data, []byte("PK\x03\x04fake zip bytes")...)
+	src := filepath.Join(t.TempDir(), "host.elf")
+	require.NoError(t, os.WriteFile(src, data, 0600))
+	f, err := os.Open(src) // nolint: gosec
+	require.NoError(t, err)
+	defer f.Close() // nolint: errcheck
+
+	dest := t.TempDir()
+	require.NoError(t, writeHostExecutable(f, dest, "host", appendedOffset, int64(len(data)), true))
+
+	got, err := os.ReadFile(filepath.Join(dest, "host"))
+	require.NoError(t, err)
+	assert.Equal(t, data[:appendedOffset], got)
+}